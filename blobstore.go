@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/txchen/tlog"
+	"github.com/txchen/wp_download/internal/manifest"
+)
+
+// blobsRoot holds every downloaded image exactly once, keyed by its sha256
+// checksum. The classic images/{H,NH}/YYYY/MM/DD/ tree is kept around as
+// hardlinks into this store, mirroring Docker's graph/layer store so the
+// same image url appearing under both filters doesn't cost double storage.
+const blobsRoot = "images/blobs/sha256"
+
+// blobPath returns the content-addressable location for an image whose
+// checksum is sha256Hex, e.g. images/blobs/sha256/ab/cd/abcd....jpg
+func blobPath(sha256Hex string) string {
+	return filepath.Join(blobsRoot, sha256Hex[0:2], sha256Hex[2:4], sha256Hex+".jpg")
+}
+
+// storeBlob moves a fully-downloaded file at tempPath into the blob store
+// under its sha256 checksum, then hardlinks it into the classic tree at
+// imageFileName. If the checksum is already stored -- e.g. the same image
+// appearing under both the H and NH trees -- the existing blob is reused
+// and tempPath is discarded instead of stored a second time.
+func storeBlob(tempPath string, sha256Hex string, imageFileName string) error {
+	blob := blobPath(sha256Hex)
+
+	if _, err := os.Stat(blob); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return fmt.Errorf("cannot create blob dir: %v, %v", filepath.Dir(blob), err)
+		}
+		if err := os.Rename(tempPath, blob); err != nil {
+			return fmt.Errorf("cannot move %v into blob store: %v", tempPath, err)
+		}
+	} else if err := os.Remove(tempPath); err != nil {
+		return fmt.Errorf("cannot discard duplicate of %v: %v", blob, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(imageFileName), 0755); err != nil {
+		return fmt.Errorf("cannot create dir: %v, %v", filepath.Dir(imageFileName), err)
+	}
+	os.Remove(imageFileName) // replace a stale file/link left by a previous run, if any
+	if err := os.Link(blob, imageFileName); err != nil {
+		return fmt.Errorf("cannot link %v into %v: %v", blob, imageFileName, err)
+	}
+	return nil
+}
+
+// migrateToBlobs walks the legacy images/{H,NH} date-tree, moving every
+// image already on disk into the blob store, replacing it with a hardlink,
+// and recording it as a completed manifest entry -- for installs upgrading
+// from before either the manifest (chunk0-2) or the blob layout existed.
+// Without the manifest write, the very next run would see these urls as
+// unknown/pending and re-download every one of them from the network.
+func migrateToBlobs(m *manifest.Manifest) error {
+	roots := []struct {
+		dir string
+		h   bool
+	}{
+		{"images/H", true},
+		{"images/NH", false},
+	}
+
+	for _, root := range roots {
+		err := filepath.Walk(root.dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || filepath.Ext(p) != ".jpg" {
+				return nil
+			}
+
+			sha256Hex, err := manifest.HashFile(p)
+			if err != nil {
+				return fmt.Errorf("cannot hash %v: %v", p, err)
+			}
+			size := info.Size()
+
+			blob := blobPath(sha256Hex)
+			if _, err := os.Stat(blob); os.IsNotExist(err) {
+				if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+					return err
+				}
+				// copy rather than rename: p may already be hardlinked to
+				// the same content under the other filter's tree
+				if err := copyFile(p, blob); err != nil {
+					return fmt.Errorf("cannot copy %v into blob store: %v", p, err)
+				}
+			} else if err != nil {
+				return err
+			}
+
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			if err := os.Link(blob, p); err != nil {
+				return fmt.Errorf("cannot link %v into %v: %v", blob, p, err)
+			}
+
+			url := filepath.Base(p)
+			if existingH, ok, err := m.Lookup(url); err != nil {
+				return fmt.Errorf("cannot look up manifest entry for %v: %v", url, err)
+			} else if ok && existingH != root.h {
+				// url is physically present under both images/H and
+				// images/NH (the same getAllImageUrls hi/nh overlap bug
+				// the pool guards against elsewhere); UpsertRemote's
+				// INSERT OR IGNORE would silently keep whichever tree's
+				// walk ran first, making this one permanently invisible to
+				// Pending/Completed/the daemon's listing under its real
+				// tree.
+				tlog.WARN.Printf("%v present under both H and NH trees, manifest already records h=%v, keeping that", url, existingH)
+			}
+			if err := m.UpsertRemote(url, root.h); err != nil {
+				return fmt.Errorf("cannot record manifest entry for %v: %v", url, err)
+			}
+			if err := m.MarkComplete(url, size, sha256Hex); err != nil {
+				return fmt.Errorf("cannot mark %v complete in manifest: %v", url, err)
+			}
+
+			tlog.INFO.Printf("migrated %v into blob store as %v", p, filepath.Base(blob))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
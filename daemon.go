@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/txchen/tlog"
+	"github.com/txchen/wp_download/internal/manifest"
+)
+
+// authTokenEnv names the environment variable holding the bearer token the
+// daemon requires on every request, when set. Leaving it unset runs the
+// daemon without auth, which is only appropriate bound to localhost.
+const authTokenEnv = "WP_DOWNLOAD_TOKEN"
+
+// jobStatus is the lifecycle state of a sync job.
+type jobStatus string
+
+const (
+	jobPending jobStatus = "pending"
+	jobRunning jobStatus = "running"
+	jobDone    jobStatus = "done"
+	jobFailed  jobStatus = "failed"
+)
+
+// job tracks a single download cycle triggered by POST /sync.
+type job struct {
+	ID           string    `json:"id"`
+	Status       jobStatus `json:"status"`
+	HDownloaded  int       `json:"h_downloaded"`
+	NHDownloaded int       `json:"nh_downloaded"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// daemon serves the JSON HTTP API and schedules download cycles triggered
+// by POST /sync, as a long-running alternative to the one-shot -download
+// run. The CLI does not talk to the daemon: -download still runs its
+// download cycle in-process.
+type daemon struct {
+	m    *manifest.Manifest
+	pool *downloadPool
+
+	mu          sync.Mutex
+	concurrency int
+	jobs        map[string]*job
+	nextJobID   int
+}
+
+func newDaemon(m *manifest.Manifest, concurrency int) *daemon {
+	return &daemon{m: m, pool: newDownloadPool(), concurrency: concurrency, jobs: make(map[string]*job)}
+}
+
+// requireAuth wraps h with a bearer-token check against authTokenEnv. If
+// that env var isn't set, auth is skipped entirely.
+func (d *daemon) requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	token := os.Getenv(authTokenEnv)
+	if token == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (d *daemon) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images", d.requireAuth(d.handleImages))
+	mux.HandleFunc("/images/", d.requireAuth(d.handleImage))
+	mux.HandleFunc("/sync", d.requireAuth(d.handleSync))
+	mux.HandleFunc("/jobs/", d.requireAuth(d.handleJob))
+	mux.HandleFunc("/config", d.requireAuth(d.handleConfig))
+	return mux
+}
+
+// GET /images?filter=h|nh
+func (d *daemon) handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var h bool
+	switch r.URL.Query().Get("filter") {
+	case "h":
+		h = true
+	case "nh", "":
+		h = false
+	default:
+		http.Error(w, "filter must be h or nh", http.StatusBadRequest)
+		return
+	}
+	urls, err := d.m.Completed(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, urls)
+}
+
+// GET/DELETE /images/{name}
+func (d *daemon) handleImage(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/images/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	h, ok, err := d.m.Lookup(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !fnRegex.MatchString(name) {
+		// a manifest row pre-dating the fnRegex check that upsertRemote and
+		// startSyncJob make before UpsertRemote, or one recorded by
+		// migrateToBlobs, which does not check names --
+		// imagePaths slices name[0:6] unconditionally, so refuse it here
+		// rather than letting it panic the daemon.
+		http.Error(w, "malformed image name", http.StatusInternalServerError)
+		return
+	}
+	_, imageFileName, _ := imagePaths(name, h)
+
+	switch r.Method {
+	case http.MethodGet:
+		http.ServeFile(w, r, imageFileName)
+	case http.MethodDelete:
+		if err := os.Remove(imageFileName); err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := d.m.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /sync
+func (d *daemon) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := d.startSyncJob()
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, job{ID: id, Status: jobPending})
+}
+
+// GET /jobs/{id}
+func (d *daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	d.mu.Lock()
+	j, ok := d.jobs[id]
+	var snapshot job
+	if ok {
+		snapshot = *j
+	}
+	d.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, snapshot)
+}
+
+type configUpdate struct {
+	Concurrency int `json:"concurrency"`
+}
+
+// PUT /config
+func (d *daemon) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var cfg configUpdate
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cfg.Concurrency <= 0 {
+		http.Error(w, "concurrency must be positive", http.StatusBadRequest)
+		return
+	}
+	d.mu.Lock()
+	d.concurrency = cfg.Concurrency
+	d.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startSyncJob registers a new job and runs one download cycle for it in
+// the background, reusing getAllImageUrls/goGetImages exactly as the
+// one-shot CLI path does.
+func (d *daemon) startSyncJob() string {
+	d.mu.Lock()
+	d.nextJobID++
+	j := &job{ID: strconv.Itoa(d.nextJobID), Status: jobPending}
+	d.jobs[j.ID] = j
+	concurrency := d.concurrency
+	d.mu.Unlock()
+
+	go func() {
+		d.setJobStatus(j, jobRunning)
+
+		hi, nhi := getAllImageUrls()
+		for _, url := range hi {
+			if !fnRegex.MatchString(url) {
+				tlog.ERROR.Printf("skipping malformed remote url: %v", url)
+				continue
+			}
+			if err := d.m.UpsertRemote(url, true); err != nil {
+				d.failJob(j, err)
+				return
+			}
+		}
+		for _, url := range nhi {
+			if !fnRegex.MatchString(url) {
+				tlog.ERROR.Printf("skipping malformed remote url: %v", url)
+				continue
+			}
+			if err := d.m.UpsertRemote(url, false); err != nil {
+				d.failJob(j, err)
+				return
+			}
+		}
+
+		htodown, err := d.m.Pending(true)
+		if err != nil {
+			d.failJob(j, err)
+			return
+		}
+		nhtodown, err := d.m.Pending(false)
+		if err != nil {
+			d.failJob(j, err)
+			return
+		}
+
+		hDownloaded := goGetImages(true, concurrency, htodown, nil, d.m, d.pool)
+		nhDownloaded := goGetImages(false, concurrency, nhtodown, nil, d.m, d.pool)
+
+		d.mu.Lock()
+		j.Status = jobDone
+		j.HDownloaded = len(hDownloaded)
+		j.NHDownloaded = len(nhDownloaded)
+		d.mu.Unlock()
+	}()
+
+	return j.ID
+}
+
+func (d *daemon) setJobStatus(j *job, status jobStatus) {
+	d.mu.Lock()
+	j.Status = status
+	d.mu.Unlock()
+}
+
+func (d *daemon) failJob(j *job, err error) {
+	d.mu.Lock()
+	j.Status = jobFailed
+	j.Error = err.Error()
+	d.mu.Unlock()
+	tlog.ERROR.Printf("sync job %v failed: %v", j.ID, err)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		tlog.ERROR.Printf("failed to write json response: %v", err)
+	}
+}
+
+// runDaemon starts the JSON HTTP API and blocks until the server exits.
+func runDaemon(addr string, m *manifest.Manifest, concurrency int) error {
+	d := newDaemon(m, concurrency)
+	tlog.INFO.Printf("daemon listening on %v", addr)
+	return http.ListenAndServe(addr, d.routes())
+}
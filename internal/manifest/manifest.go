@@ -0,0 +1,208 @@
+// Package manifest maintains a small SQLite-backed index of every known
+// remote image url: its H/NH classification, content-length and sha256
+// checksum once verified, download timestamp, and retry count. It replaces
+// diffing filepath.Glob output against the remote url lists on every run.
+package manifest
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS images (
+	url            TEXT PRIMARY KEY,
+	h              INTEGER NOT NULL,
+	content_length INTEGER NOT NULL DEFAULT -1,
+	sha256         TEXT NOT NULL DEFAULT '',
+	downloaded_at  INTEGER NOT NULL DEFAULT 0,
+	retry_count    INTEGER NOT NULL DEFAULT 0,
+	completed      INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// Manifest wraps the sqlite database backing the image index.
+type Manifest struct {
+	db *sql.DB
+}
+
+// Open opens (creating and migrating if necessary) the manifest database at path.
+func Open(path string) (*Manifest, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open manifest db: %v, %v", path, err)
+	}
+	// goGetImages fires up to `concurrency` simultaneous writers (retry
+	// counts, completion markers); sqlite only ever allows one writer at a
+	// time, so keep a single connection rather than let database/sql pool
+	// several and serialize through SQLITE_BUSY retries instead.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot initialize manifest schema: %v", err)
+	}
+	return &Manifest{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (m *Manifest) Close() error {
+	return m.db.Close()
+}
+
+// UpsertRemote records a url seen in the remote image list, leaving any
+// existing row (and its completed/checksum state) untouched.
+func (m *Manifest) UpsertRemote(url string, h bool) error {
+	_, err := m.db.Exec(`INSERT OR IGNORE INTO images (url, h) VALUES (?, ?)`, url, boolToInt(h))
+	return err
+}
+
+// Pending returns the urls for the given H/NH tree that are not yet marked
+// completed in the manifest.
+func (m *Manifest) Pending(h bool) ([]string, error) {
+	rows, err := m.db.Query(`SELECT url FROM images WHERE h = ? AND completed = 0`, boolToInt(h))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// Completed returns the urls for the given H/NH tree that are marked
+// completed in the manifest.
+func (m *Manifest) Completed(h bool) ([]string, error) {
+	rows, err := m.db.Query(`SELECT url FROM images WHERE h = ? AND completed = 1`, boolToInt(h))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// Lookup returns the H/NH classification for url, and whether url is known
+// to the manifest at all.
+func (m *Manifest) Lookup(url string) (h bool, ok bool, err error) {
+	var hInt int
+	err = m.db.QueryRow(`SELECT h FROM images WHERE url = ?`, url).Scan(&hInt)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return hInt != 0, true, nil
+}
+
+// Delete removes url from the manifest entirely, e.g. after its on-disk
+// file has been removed.
+func (m *Manifest) Delete(url string) error {
+	_, err := m.db.Exec(`DELETE FROM images WHERE url = ?`, url)
+	return err
+}
+
+// IncrementRetry bumps the retry count for url after a failed attempt.
+func (m *Manifest) IncrementRetry(url string) error {
+	_, err := m.db.Exec(`UPDATE images SET retry_count = retry_count + 1 WHERE url = ?`, url)
+	return err
+}
+
+// MarkComplete records a successful, checksum-verified download.
+func (m *Manifest) MarkComplete(url string, contentLength int64, sha256Hex string) error {
+	_, err := m.db.Exec(
+		`UPDATE images SET completed = 1, content_length = ?, sha256 = ?, downloaded_at = ? WHERE url = ?`,
+		contentLength, sha256Hex, time.Now().Unix(), url,
+	)
+	return err
+}
+
+// HashFile computes the sha256 checksum of an on-disk image, used both
+// right after a download and by Verify during reconciliation.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify re-hashes every on-disk image the manifest believes is complete,
+// using pathFor to map a url/h pair to its on-disk location, and un-marks
+// any row whose checksum no longer matches or whose file is missing --
+// catching truncated files that a crash left behind as a seemingly valid
+// .jpg. It returns the urls that failed reconciliation.
+func (m *Manifest) Verify(pathFor func(url string, h bool) string) (mismatched []string, err error) {
+	rows, err := m.db.Query(`SELECT url, h, sha256 FROM images WHERE completed = 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	type row struct {
+		url    string
+		h      bool
+		sha256 string
+	}
+	var toCheck []row
+	for rows.Next() {
+		var r row
+		var hInt int
+		if err := rows.Scan(&r.url, &hInt, &r.sha256); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.h = hInt != 0
+		toCheck = append(toCheck, r)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range toCheck {
+		actual, hashErr := HashFile(pathFor(r.url, r.h))
+		if hashErr != nil || actual != r.sha256 {
+			mismatched = append(mismatched, r.url)
+			if _, err := m.db.Exec(`UPDATE images SET completed = 0 WHERE url = ?`, r.url); err != nil {
+				return mismatched, err
+			}
+		}
+	}
+	return mismatched, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -4,16 +4,17 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"time"
 
+	"github.com/cheggaaa/pb"
 	"github.com/txchen/tlog"
+	"github.com/txchen/wp_download/internal/manifest"
 )
 
 type imageSet struct {
@@ -25,86 +26,241 @@ type acgResult struct {
 }
 
 type downloadResult struct {
-	downloaded bool
-	data       []byte
-	err        error
-	url        string
-	h          bool
+	downloaded   bool
+	bytesWritten int64
+	err          error
+	url          string
+	h            bool
 }
 
 const imageBaseURL = "http://acg.sugling.in/_uploadfiles/iphone5/640/"
 const maxRetries = 3
+const manifestDBFile = "wp_download.db"
 
 var fnRegex = regexp.MustCompile("\\d{6}\\d+\\.jpg")
 
-func downloadImage(url string, h bool) downloadResult {
+// upsertRemote validates url against fnRegex before recording it in the
+// manifest. Without this, a malformed url from the remote image listing
+// (too short, wrong extension) would only be caught later by
+// downloadImage -- but handleImage's GET/DELETE /images/{name} reads
+// straight from the manifest, and imagePaths slices url[0:6]
+// unconditionally, so a bad url that slipped into the manifest is answered
+// there with a 500 error on every request instead of just failing to
+// download.
+func upsertRemote(m *manifest.Manifest, url string, h bool) error {
+	if !fnRegex.MatchString(url) {
+		return fmt.Errorf("image url format unexpected: %v", url)
+	}
+	return m.UpsertRemote(url, h)
+}
+
+// imagePaths computes the final date-tree directory/file name and the
+// in-progress ".tmp" file name for a given image url, under either the H or
+// NH tree.
+func imagePaths(url string, h bool) (imageDir string, imageFileName string, tempImgFileName string) {
+	imageDir = "20" + url[0:2] + "/" + url[2:4] + "/" + url[4:6] + "/"
+	if h {
+		imageDir = "images/H/" + imageDir
+	} else {
+		imageDir = "images/NH/" + imageDir
+	}
+	imageFileName = imageDir + url
+	tempImgFileName = imageFileName + ".tmp"
+	return
+}
+
+// downloadImage streams an image straight into its ".tmp" file, resuming
+// from whatever bytes are already on disk via an HTTP Range request. This
+// lets a crash or network drop mid-download be picked up again on the next
+// run instead of restarting from scratch. progressCh, if non-nil, receives
+// a progressUpdate for every chunk read off the wire.
+func downloadImage(url string, h bool, progressCh chan<- progressUpdate) downloadResult {
 	result := downloadResult{url: url, h: h}
 	if !fnRegex.MatchString(url) {
 		result.err = fmt.Errorf("image url format unexpected: %v", url)
 		return result
 	}
 
-	response, err := http.Get(imageBaseURL + url)
-	defer response.Body.Close()
+	imageDir, _, tempImgFileName := imagePaths(url, h)
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		result.err = fmt.Errorf("cannot create dir: %v, %v", imageDir, err)
+		return result
+	}
+
+	var resumeFrom int64
+	if fi, err := os.Stat(tempImgFileName); err == nil {
+		resumeFrom = fi.Size()
+	}
+
+	req, err := http.NewRequest("GET", imageBaseURL+url, nil)
+	if err != nil {
+		result.err = fmt.Errorf("error building request for image: %v, %v", url, err)
+		return result
+	}
+	if resumeFrom > 0 {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+	}
+
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
 		result.err = fmt.Errorf("error download image from http: %v , %v", url, err)
 		return result
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// our resume offset is stale (e.g. the server-side file changed
+		// size); reset the tmp file so the next retry restarts from
+		// scratch instead of looping on the same bad offset, and don't
+		// treat the (non-image) error body as downloaded data
+		if err := os.Truncate(tempImgFileName, 0); err != nil && !os.IsNotExist(err) {
+			result.err = fmt.Errorf("cannot reset stale resume file: %v, %v", tempImgFileName, err)
+			return result
+		}
+		result.err = fmt.Errorf("resume offset rejected for %v, reset for retry", url)
+		return result
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		result.err = fmt.Errorf("unexpected status downloading image: %v, %v", url, response.Status)
+		return result
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if resumeFrom > 0 && response.StatusCode == http.StatusPartialContent {
+		flags |= os.O_APPEND
+	} else {
+		// server ignored the Range request (or we had nothing to resume),
+		// so start the tmp file over from scratch
+		resumeFrom = 0
+		flags |= os.O_TRUNC
+	}
+
+	imgFile, err := os.OpenFile(tempImgFileName, flags, 0644)
+	if err != nil {
+		result.err = fmt.Errorf("cannot open image file: %v, %v", tempImgFileName, err)
+		return result
+	}
+	defer imgFile.Close()
+
+	var body io.Reader = response.Body
+	if progressCh != nil {
+		body = &progressReader{reader: response.Body, url: url, updateCh: progressCh}
+	}
+
+	written, err := io.Copy(imgFile, body)
+	if err != nil {
+		result.err = fmt.Errorf("failed to save data to file: %v, %v", tempImgFileName, err)
+		return result
+	}
+	if err := imgFile.Sync(); err != nil {
+		result.err = fmt.Errorf("failed to sync file: %v, %v", tempImgFileName, err)
+		return result
+	}
+
+	result.bytesWritten = resumeFrom + written
+	if response.ContentLength >= 0 {
+		if expected := resumeFrom + response.ContentLength; result.bytesWritten != expected {
+			result.err = fmt.Errorf("content-length mismatch for %v: expected %d bytes, wrote %d", url, expected, result.bytesWritten)
+			return result
+		}
+	}
 
-	result.data, err = ioutil.ReadAll(response.Body)
 	result.downloaded = true
 	return result
 }
 
-func retryDownloadImage(url string, h bool) downloadResult {
+// sumContentLengths issues a HEAD request for each url, bounded by
+// concurrency, to total up the expected download size before any bytes are
+// fetched. cheggaaa/pb only enables ShowTimeLeft/ShowPercent if Start is
+// called with a nonzero Total, so without this the aggregate progress bar's
+// ETA would be permanently disabled. Urls whose size can't be determined
+// (HEAD failure, no Content-Length) simply don't contribute to the total,
+// making the ETA an underestimate rather than blocking the download.
+func sumContentLengths(urls []string, concurrency int) int64 {
+	throttle := make(chan struct{}, concurrency)
+	sizeCh := make(chan int64, len(urls))
+	for _, u := range urls {
+		go func(url string) {
+			throttle <- struct{}{}
+			defer func() { <-throttle }()
+			resp, err := http.Head(imageBaseURL + url)
+			if err != nil {
+				sizeCh <- 0
+				return
+			}
+			resp.Body.Close()
+			if resp.ContentLength < 0 {
+				sizeCh <- 0
+				return
+			}
+			sizeCh <- resp.ContentLength
+		}(u)
+	}
+	var total int64
+	for range urls {
+		total += <-sizeCh
+	}
+	return total
+}
+
+func retryDownloadImage(url string, h bool, progressCh chan<- progressUpdate, m *manifest.Manifest) downloadResult {
 	result := downloadResult{}
 	for i := 0; i < maxRetries; i++ {
-		result = downloadImage(url, h)
+		result = downloadImage(url, h, progressCh)
 		if result.err == nil {
 			break
 		}
+		if err := m.IncrementRetry(url); err != nil {
+			tlog.ERROR.Printf("failed to record retry for %v: %v", url, err)
+		}
 		time.Sleep(500 * time.Millisecond)
 	}
 	return result
 }
 
-func saveImage(result downloadResult) (downloaded string) {
+func saveImage(result downloadResult, h bool, m *manifest.Manifest) (downloaded string) {
 	if !result.downloaded {
 		tlog.ERROR.Printf("image not downloaded: %v, %v", result.url, result.err)
 		return
 	}
 
-	// check if the file is already there
-	imageDir := "20" + result.url[0:2] + "/" + result.url[2:4] + "/" + result.url[4:6] + "/"
-	if result.h {
-		imageDir = "images/H/" + imageDir
-	} else {
-		imageDir = "images/NH/" + imageDir
-	}
-	imageFileName := imageDir + result.url
-	tempImgFileName := imageFileName + ".tmp"
+	_, imageFileName, tempImgFileName := imagePaths(result.url, h)
 
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
-		tlog.ERROR.Printf("cannot create dir: %v, %v", imageDir, err)
+	if h != result.h {
+		// manifest.UpsertRemote's INSERT OR IGNORE fixes a url's h forever
+		// at first insert, so Pending(true)/Pending(false) are always
+		// disjoint and this should be unreachable; guard against it rather
+		// than silently mislabeling the download under the wrong tree.
+		tlog.ERROR.Printf("pool coalesced %v across trees (h=%v, result.h=%v), skipping", result.url, h, result.h)
 		return
 	}
-	imgFile, err := os.Create(tempImgFileName)
-	if err != nil {
-		tlog.ERROR.Printf("cannot create image file: %v, %v", tempImgFileName, err)
+
+	if _, err := os.Stat(tempImgFileName); os.IsNotExist(err) {
+		// a pool-coalesced duplicate call for the same (url, h): the leader
+		// already consumed tempImgFileName in storeBlob, so there's nothing
+		// left for this call to do. Checking imageFileName instead would
+		// also fire for a stray pre-existing file -- e.g. a crash between
+		// storeBlob and m.MarkComplete, or a --verify repair -- and would
+		// silently discard a genuine new download.
+		downloaded = imageFileName
 		return
 	}
-	defer imgFile.Close()
 
-	_, err = imgFile.Write(result.data)
+	sha256Hex, err := manifest.HashFile(tempImgFileName)
 	if err != nil {
-		tlog.ERROR.Printf("failed to save data to file: %v, %v", tempImgFileName, err)
+		tlog.ERROR.Printf("failed to hash downloaded file, leaving it pending: %v, %v", tempImgFileName, err)
+		return
+	}
+	if err := storeBlob(tempImgFileName, sha256Hex, imageFileName); err != nil {
+		tlog.ERROR.Printf("failed to store image in blob layout: %v, %v", imageFileName, err)
+		return
+	}
+	if err := m.MarkComplete(result.url, result.bytesWritten, sha256Hex); err != nil {
+		tlog.ERROR.Printf("failed to record manifest entry for %v: %v", imageFileName, err)
 		return
 	}
-	imgFile.Sync()
-	imgFile.Close()
 
-	os.Rename(tempImgFileName, imageFileName)
-	tlog.INFO.Printf("image %v downloaded, size: %d", imageFileName, len(result.data))
+	tlog.INFO.Printf("image %v downloaded, size: %d", imageFileName, result.bytesWritten)
 	downloaded = imageFileName
 	return
 }
@@ -162,33 +318,25 @@ func getImageUrls(hfilter bool) []string {
 	return images
 }
 
-func getLocalImages() (hImages []string, nhImages []string) {
-	var _ error
-	hImages, _ = filepath.Glob("./images/H/*/*/*/*.jpg")
-	for i := 0; i < len(hImages); i++ {
-		hImages[i] = path.Base(hImages[i])
-	}
-
-	nhImages, _ = filepath.Glob("./images/NH/*/*/*/*.jpg")
-	for i := 0; i < len(nhImages); i++ {
-		nhImages[i] = path.Base(nhImages[i])
-	}
-	return
-}
-
-func goGetImages(h bool, concurrency int, urls []string) (downloaded []string) {
+func goGetImages(h bool, concurrency int, urls []string, progressCh chan<- progressUpdate, m *manifest.Manifest, pool *downloadPool) (downloaded []string) {
 	throttle := make(chan int, concurrency)
 	dataCh := make(chan downloadResult, concurrency)
 	for _, u := range urls {
 		go func(url string) {
 			throttle <- 0
-			dataCh <- retryDownloadImage(url, h)
-			<-throttle
+			defer func() { <-throttle }()
+
+			key := poolKey(url)
+			ch, leader := pool.join(key)
+			if leader {
+				pool.broadcast(key, retryDownloadImage(url, h, progressCh, m))
+			}
+			dataCh <- <-ch
 		}(u)
 	}
 
 	for i := 0; i < len(urls); i++ {
-		si := saveImage(<-dataCh)
+		si := saveImage(<-dataCh, h, m)
 		if si != "" {
 			downloaded = append(downloaded, si)
 		}
@@ -199,31 +347,115 @@ func goGetImages(h bool, concurrency int, urls []string) (downloaded []string) {
 func main() {
 	verbose := flag.Bool("v", false, "verbose")
 	download := flag.Bool("download", false, "download")
+	verify := flag.Bool("verify", false, "re-hash on-disk images and reconcile against the manifest")
+	noProgress := flag.Bool("no-progress", false, "disable the aggregate progress bar during download")
+	silent := flag.Bool("silent", false, "suppress the progress bar and non-essential log output")
+	daemonMode := flag.Bool("daemon", false, "run as a long-lived daemon exposing a JSON HTTP API instead of a one-shot run")
+	migrateBlobs := flag.Bool("migrate-blobs", false, "one-shot migration of the legacy images/{H,NH} tree into the content-addressable blob store")
+	addr := flag.String("addr", "127.0.0.1:8090", "address for -daemon to listen on")
+	concurrency := flag.Int("concurrency", 10, "initial worker pool size, adjustable at runtime via PUT /config in -daemon mode")
 	flag.Parse()
-	if *verbose {
+	if *silent {
+		tlog.SetConsoleLogLevel(tlog.LevelError)
+	} else if *verbose {
 		tlog.SetConsoleLogLevel(tlog.LevelDebug)
 	} else {
 		tlog.SetConsoleLogLevel(tlog.LevelInfo)
 	}
 
-	tlog.INFO.Println("Getting local images from disk...")
-	hli, nhli := getLocalImages()
-	tlog.INFO.Printf("Local H images count = %d", len(hli))
-	tlog.INFO.Printf("Local non-H images count = %d", len(nhli))
+	m, err := manifest.Open(manifestDBFile)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer m.Close()
+
+	if *migrateBlobs {
+		if err := migrateToBlobs(m); err != nil {
+			panic(err.Error())
+		}
+		tlog.INFO.Printf("Migration into blob store complete")
+		return
+	}
+
+	if *daemonMode {
+		if err := runDaemon(*addr, m, *concurrency); err != nil {
+			panic(err.Error())
+		}
+		return
+	}
+
+	if *verify {
+		mismatched, err := m.Verify(func(url string, h bool) string {
+			_, imageFileName, _ := imagePaths(url, h)
+			return imageFileName
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+		tlog.INFO.Printf("Verify complete, %d image(s) failed reconciliation and were reset to pending", len(mismatched))
+		for _, url := range mismatched {
+			tlog.WARN.Printf("manifest mismatch, will re-download: %v", url)
+		}
+		return
+	}
 
 	tlog.INFO.Println("Getting all image urls from ACG...")
 	hi, nhi := getAllImageUrls()
 	tlog.INFO.Printf("Total H images count = %d", len(hi))
 	tlog.INFO.Printf("Total non-H images count = %d", len(nhi))
 
-	htodown := difference(hi, hli)
-	nhtodown := difference(nhi, nhli)
+	for _, url := range hi {
+		if err := upsertRemote(m, url, true); err != nil {
+			tlog.ERROR.Printf("failed to record remote url in manifest: %v, %v", url, err)
+		}
+	}
+	for _, url := range nhi {
+		if err := upsertRemote(m, url, false); err != nil {
+			tlog.ERROR.Printf("failed to record remote url in manifest: %v, %v", url, err)
+		}
+	}
+
+	htodown, err := m.Pending(true)
+	if err != nil {
+		panic(err.Error())
+	}
+	nhtodown, err := m.Pending(false)
+	if err != nil {
+		panic(err.Error())
+	}
 	tlog.INFO.Printf("Total H images to download = %d", len(htodown))
 	tlog.INFO.Printf("Total non-H images to download = %d", len(nhtodown))
 
 	if *download {
-		hDownloaded := goGetImages(true, 10, htodown)
-		nhDownloaded := goGetImages(false, 10, nhtodown)
+		pool := newDownloadPool()
+		var progressCh chan progressUpdate
+		var progressDone chan struct{}
+		var bar *pb.ProgressBar
+		if !*noProgress && !*silent {
+			progressCh = make(chan progressUpdate, 100)
+			progressDone = make(chan struct{})
+			total := sumContentLengths(append(append([]string{}, htodown...), nhtodown...), *concurrency)
+			bar = pb.New64(total)
+			bar.SetUnits(pb.U_BYTES)
+			bar.ShowBar = false
+			bar.ShowSpeed = true
+			bar.Start()
+			go func() {
+				for u := range progressCh {
+					bar.Add64(u.read)
+				}
+				close(progressDone)
+			}()
+		}
+
+		hDownloaded := goGetImages(true, *concurrency, htodown, progressCh, m, pool)
+		nhDownloaded := goGetImages(false, *concurrency, nhtodown, progressCh, m, pool)
+
+		if progressCh != nil {
+			close(progressCh)
+			<-progressDone
+			bar.Finish()
+		}
 
 		tlog.INFO.Printf("Done")
 		tlog.INFO.Printf("Total H images downloaded = %d", len(hDownloaded))
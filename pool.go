@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+)
+
+// downloadPool coalesces concurrent requests for the same image so only
+// one retryDownloadImage call is ever in flight for it at a time, modeled
+// on Docker's TagStore pull/push pool (graph/pull.go). A goroutine that
+// joins the pool while another is already downloading the same key blocks
+// until that download finishes and reuses its result instead of issuing a
+// second http.Get.
+type downloadPool struct {
+	mu      sync.Mutex
+	waiters map[string][]chan downloadResult
+}
+
+func newDownloadPool() *downloadPool {
+	return &downloadPool{waiters: make(map[string][]chan downloadResult)}
+}
+
+// poolKey is keyed by url alone, per the pool's purpose: coalescing every
+// concurrent request for the same image, not just same-tree ones.
+func poolKey(url string) string {
+	return url
+}
+
+// join registers the caller's interest in key. If leader is true, the
+// caller must perform the download itself and call broadcast with the
+// result; otherwise it should block on ch for the leader's result.
+func (p *downloadPool) join(key string) (ch chan downloadResult, leader bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch = make(chan downloadResult, 1)
+	existing, inFlight := p.waiters[key]
+	p.waiters[key] = append(existing, ch)
+	return ch, !inFlight
+}
+
+// broadcast delivers result to every goroutine waiting on key, including
+// the leader, and removes key from the pool.
+func (p *downloadPool) broadcast(key string, result downloadResult) {
+	p.mu.Lock()
+	waiters := p.waiters[key]
+	delete(p.waiters, key)
+	p.mu.Unlock()
+
+	for _, ch := range waiters {
+		ch <- result
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestDownloadPoolJoinLeader(t *testing.T) {
+	p := newDownloadPool()
+
+	if _, leader := p.join("url1"); !leader {
+		t.Fatal("first joiner on a key should be the leader")
+	}
+	if _, leader := p.join("url1"); leader {
+		t.Fatal("second joiner on the same key should not be the leader")
+	}
+	if _, leader := p.join("url2"); !leader {
+		t.Fatal("first joiner on a different key should be the leader")
+	}
+}
+
+func TestDownloadPoolBroadcast(t *testing.T) {
+	p := newDownloadPool()
+
+	const waiters = 5
+	chs := make([]chan downloadResult, waiters)
+	for i := range chs {
+		ch, _ := p.join("url")
+		chs[i] = ch
+	}
+
+	want := downloadResult{url: "url", downloaded: true, bytesWritten: 42}
+	p.broadcast("url", want)
+
+	var wg sync.WaitGroup
+	for _, ch := range chs {
+		wg.Add(1)
+		go func(ch chan downloadResult) {
+			defer wg.Done()
+			if got := <-ch; got != want {
+				t.Errorf("waiter got %+v, want %+v", got, want)
+			}
+		}(ch)
+	}
+	wg.Wait()
+
+	// broadcast clears the key, so the next joiner should become the
+	// leader again instead of blocking on a stale waiter list
+	if _, leader := p.join("url"); !leader {
+		t.Fatal("joiner after broadcast should be the leader again")
+	}
+}
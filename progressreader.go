@@ -0,0 +1,28 @@
+package main
+
+import "io"
+
+// progressUpdate reports incremental progress for a single URL's download,
+// mirroring the streaming progress events Docker's pull/import code emits
+// while copying layer data.
+type progressUpdate struct {
+	url  string
+	read int64
+}
+
+// progressReader wraps an io.Reader and publishes the number of bytes read
+// on updateCh as the wrapped reader is consumed. updateCh may be nil, in
+// which case progressReader behaves like a plain passthrough.
+type progressReader struct {
+	reader   io.Reader
+	url      string
+	updateCh chan<- progressUpdate
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 && p.updateCh != nil {
+		p.updateCh <- progressUpdate{url: p.url, read: int64(n)}
+	}
+	return n, err
+}